@@ -1,15 +1,25 @@
 package main
 
 import (
+	"bufio"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/registry"
 	"gopkg.in/ini.v1"
 )
@@ -27,64 +37,931 @@ type Payload struct {
 	Geometry string `json:"geometry,omitempty"` // MPV 专用: 窗口位置 (50%x50%+0+0)
 	Title    string `json:"title,omitempty"`    // 通用: 窗口标题
 	Sub      string `json:"sub,omitempty"`      // 通用: 字幕文件 URL
+	Instance string `json:"instance,omitempty"` // 控制桥专用: 本次播放的稳定实例 ID，省略时按 Url 派生
+
+	Playlist []PlaylistItem `json:"playlist,omitempty"` // 播放列表模式: 多个条目，优先级高于单独的 Url
+	Shuffle  bool           `json:"shuffle,omitempty"`  // 播放列表模式: 是否随机播放顺序
+	Loop     string         `json:"loop,omitempty"`     // 播放列表模式: 循环模式，例如 "inf"、"3"
+
+	Proxy   string            `json:"proxy,omitempty"`   // "hls" 强制走代理，"auto" 按 Headers/扩展名自动判断
+	Headers map[string]string `json:"headers,omitempty"` // 请求 Url 时要带上的认证头，例如 Jellyfin 的 X-Emby-Token
+
+	// extraSubs/audioFile 不来自前端，是 [probe] 开启时探测阶段自动发现的同目录字幕/音轨，
+	// buildMpvCmd 会把它们拼成 --sub-files / --audio-file
+	extraSubs []string
+	audioFile string
+}
+
+// PlaylistItem 是播放列表里的单个条目，字段含义和 Payload 里的同名字段一致
+type PlaylistItem struct {
+	Url     string `json:"url"`
+	Title   string `json:"title,omitempty"`
+	Sub     string `json:"sub,omitempty"`
+	Start   string `json:"start,omitempty"`   // 起始播放时间，例如 "00:05:00"
+	Profile string `json:"profile,omitempty"` // 该条目单独使用的 profile，留空则继承 Payload.Profile
+}
+
+// PlayerEntry 描述 INI 中一个播放器条目：可执行文件路径 + 命令行模板
+// 模板驱动：不再需要为每个新播放器写一个 buildXxxCmd，加一行 INI 配置即可
+type PlayerEntry struct {
+	BinPath  string
+	Template string
 }
 
 // Config 定义了本地配置文件的结构
 type Config struct {
-	MpvPath   string
-	PotPath   string
 	EnableLog bool
 	LogPath   string
+
+	// Players 以 mode 名称为 key，例如 "mpv"、"potplayer"，也支持用户自定义的 "vlc"、"iina" 等
+	Players map[string]PlayerEntry
+
+	// Profiles 来自 [profiles.<name>] 小节，key 是参数名，value 是参数值（为空则视为开关型参数）
+	Profiles map[string]map[string]string
+
+	// BridgeEnabled / BridgePort 来自 [bridge] 小节，控制 mpv IPC 控制桥是否启用、监听哪个本地端口
+	BridgeEnabled bool
+	BridgePort    int
+
+	// ProbeEnabled / ProbePath 来自 [probe] 小节，控制要不要在拉起播放器之前先用 ffprobe 探测一下流
+	ProbeEnabled bool
+	ProbePath    string
+
+	// ProxyCacheMaxMB 来自 [proxy] 小节，限制 HLS 代理的本地分片缓存能占多少磁盘空间
+	ProxyCacheMaxMB int
+
+	// SingleInstanceEnabled / SingleInstanceOnDuplicate 来自 [single_instance] 小节，
+	// 控制重复点击协议链接时是开新窗口、替换、追加播放列表还是直接忽略
+	SingleInstanceEnabled     bool
+	SingleInstanceOnDuplicate string
 }
 
 // PlayerHandler 是一个函数类型，用于将通用 Payload 转换为具体播放器的 exec.Cmd
-type PlayerHandler func(binPath string, p *Payload) *exec.Cmd
+// 额外传入 cfg，是因为模板和 profile 额外参数都要从配置里取
+// 第二个返回值是收尾回调（没有则为 nil），调用方要在播放器退出后调用它，
+// 用来删临时播放列表文件、关 HLS 代理这类"这次播放专属"的资源
+type PlayerHandler func(cfg *Config, binPath string, p *Payload) (*exec.Cmd, func())
+
+// combineCleanups 把多个收尾回调合并成一个，nil 回调会被跳过；一个都没有就返回 nil
+func combineCleanups(fns []func()) func() {
+	var nonNil []func()
+	for _, fn := range fns {
+		if fn != nil {
+			nonNil = append(nonNil, fn)
+		}
+	}
+	fns = nonNil
+	if len(fns) == 0 {
+		return nil
+	}
+	return func() {
+		for _, fn := range fns {
+			fn()
+		}
+	}
+}
 
 // ==========================================
 // 2. 扩展核心：播放器处理器注册表
 // ==========================================
 
+// defaultMpvTemplate / defaultPotplayerTemplate 是用户没有在 INI 里写 *_template 时的兜底模板，
+// 对应的是旧版本硬编码的参数拼接逻辑，保证升级后行为不变
+const defaultMpvTemplate = `%url% --profile=%profile% --geometry=%geometry% --force-media-title=%title% --sub-file=%sub%`
+const defaultPotplayerTemplate = `%url%`
+
 // Handlers 映射表：将 "mode" 字符串映射到具体的构建逻辑
-// 扩展性：想加 VLC？只需在这里加一行 "vlc": buildVlcCmd，然后在下面写实现函数即可
+// 扩展性：想加 VLC？只需在 INI 的 [players] 里加上 `vlc = <路径>` 和 `vlc_template = ...` 两行，完全不用碰这个文件
 var Handlers = map[string]PlayerHandler{
 	"mpv":       buildMpvCmd,
 	"potplayer": buildPotPlayerCmd,
 }
 
-// buildMpvCmd 负责构建 MPV 的复杂参数
-func buildMpvCmd(binPath string, p *Payload) *exec.Cmd {
-	args := []string{p.Url}
+// buildMpvCmd 负责构建 MPV 的参数，实际的拼接逻辑都在模板引擎里
+func buildMpvCmd(cfg *Config, binPath string, p *Payload) (*exec.Cmd, func()) {
+	tmpl := cfg.Players["mpv"].Template
+	if tmpl == "" {
+		tmpl = defaultMpvTemplate
+	}
+
+	fields := payloadFields(p)
+	var cleanups []func()
+	var playlistArgs []string
+	if len(p.Playlist) > 0 {
+		// 播放列表模式没有单个 url，%url% 之类的占位符会因为 fields 里没有这个 key 而被 expandTemplate 整个丢弃
+		delete(fields, "url")
+		playlistArgs = mpvPlaylistArgs(p)
+	} else if needsHLSProxy(p) {
+		localURL, stop, err := startHLSProxy(cfg, p)
+		if err != nil {
+			writeLog(cfg, "Proxy Error: "+err.Error())
+		} else {
+			fields["url"] = localURL
+			cleanups = append(cleanups, stop)
+		}
+	}
+
+	args := expandTemplate(tmpl, fields)
+	args = append(args, profileExtraArgs(cfg, p.Profile)...)
+	args = append(args, playlistArgs...)
 
-	// 动态参数注入
-	if p.Profile != "" {
-		args = append(args, "--profile="+p.Profile)
+	if p.Shuffle {
+		args = append(args, "--shuffle")
+	}
+	if p.Loop != "" {
+		args = append(args, "--loop-playlist="+p.Loop)
 	}
-	if p.Geometry != "" {
-		args = append(args, "--geometry="+p.Geometry)
+
+	// [probe] 开启时自动发现的同目录字幕/音轨兄弟文件
+	if len(p.extraSubs) > 0 {
+		args = append(args, "--sub-files="+strings.Join(p.extraSubs, ";"))
 	}
-	if p.Title != "" {
-		args = append(args, "--force-media-title="+p.Title)
+	if p.audioFile != "" {
+		args = append(args, "--audio-file="+p.audioFile)
 	}
-	if p.Sub != "" {
-		args = append(args, "--sub-file="+p.Sub)
+
+	// 控制桥开启时，带上 IPC socket，让前端之后可以 seek/pause 而不用重新拉起 mpv
+	if cfg.BridgeEnabled {
+		args = append(args, "--input-ipc-server="+mpvIPCPipeName(instanceID(p)))
 	}
 
 	// 强制为了 Video Wall 优化的参数 (可选，防止多开时的焦点抢占问题)
-	// args = append(args, "--ontop") 
+	// args = append(args, "--ontop")
 
-	return exec.Command(binPath, args...)
+	return exec.Command(binPath, args...), combineCleanups(cleanups)
 }
 
 // buildPotPlayerCmd 负责构建 PotPlayer 的参数
-func buildPotPlayerCmd(binPath string, p *Payload) *exec.Cmd {
-	// PotPlayer 命令行相对简单，主要传 URL
-	// 注意：PotPlayer 对 Title 和 Geometry 的命令行支持不如 MPV 完善
-	args := []string{p.Url}
-	return exec.Command(binPath, args...)
+// 注意：PotPlayer 对 Title 和 Geometry 的命令行支持不如 MPV 完善，默认模板里没有带上
+func buildPotPlayerCmd(cfg *Config, binPath string, p *Payload) (*exec.Cmd, func()) {
+	tmpl := cfg.Players["potplayer"].Template
+	if tmpl == "" {
+		tmpl = defaultPotplayerTemplate
+	}
+
+	fields := payloadFields(p)
+	var cleanups []func()
+	if len(p.Playlist) > 0 {
+		path, err := writePotplayerPlaylist(cfg, p)
+		if err != nil {
+			writeLog(cfg, "Playlist Error: "+err.Error())
+		} else {
+			fields["url"] = path
+			cleanups = append(cleanups, func() { os.Remove(path) })
+		}
+	} else if needsHLSProxy(p) {
+		localURL, stop, err := startHLSProxy(cfg, p)
+		if err != nil {
+			writeLog(cfg, "Proxy Error: "+err.Error())
+		} else {
+			fields["url"] = localURL
+			cleanups = append(cleanups, stop)
+		}
+	}
+
+	args := expandTemplate(tmpl, fields)
+	args = append(args, profileExtraArgs(cfg, p.Profile)...)
+	return exec.Command(binPath, args...), combineCleanups(cleanups)
+}
+
+// buildGenericCmd 是给用户自定义播放器（VLC、IINA、mpc-hc...）用的处理器，
+// 完全依赖 INI 里的 *_template，没有任何硬编码的特殊逻辑
+func buildGenericCmd(cfg *Config, binPath string, p *Payload) (*exec.Cmd, func()) {
+	entry := cfg.Players[p.Target]
+	args := expandTemplate(entry.Template, payloadFields(p))
+	args = append(args, profileExtraArgs(cfg, p.Profile)...)
+	return exec.Command(binPath, args...), nil
+}
+
+// ==========================================
+// 3. 参数模板引擎 (Template Engine)
+// ==========================================
+
+// fieldRe 匹配模板里 %field% 形式的占位符
+var fieldRe = regexp.MustCompile(`%([a-zA-Z_]+)%`)
+
+// payloadFields 把 Payload 摊平成 %field% 可以引用的键值表
+// 以后 Payload 加字段，在这里补一行就能在模板里用上
+func payloadFields(p *Payload) map[string]string {
+	return map[string]string{
+		"url":      p.Url,
+		"profile":  p.Profile,
+		"geometry": p.Geometry,
+		"title":    p.Title,
+		"sub":      p.Sub,
+		"instance": p.Instance,
+	}
+}
+
+// tokenizeTemplate 按照类 shell 的规则切分模板字符串：
+// 支持用双引号或单引号包裹含空格的片段，引号内的内容原样保留、不再二次展开
+func tokenizeTemplate(template string) []string {
+	var tokens []string
+	var cur strings.Builder
+	hasToken := false
+	var quote rune
+
+	flush := func() {
+		if hasToken {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+			hasToken = false
+		}
+	}
+
+	for _, r := range template {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			hasToken = true
+		case r == ' ' || r == '\t':
+			flush()
+		default:
+			cur.WriteRune(r)
+			hasToken = true
+		}
+	}
+	flush()
+	return tokens
+}
+
+// expandTemplate 把模板 token 里的 %field% 替换成 Payload 的实际值。
+// 如果某个 token 引用的字段是空字符串，整个 token 都会被丢弃，
+// 这样像 --sub-file=%sub% 这种可选参数在没有字幕时就会干净地消失，而不是留下一个空尾巴
+func expandTemplate(template string, fields map[string]string) []string {
+	var args []string
+	for _, tok := range tokenizeTemplate(template) {
+		drop := false
+		expanded := fieldRe.ReplaceAllStringFunc(tok, func(m string) string {
+			name := fieldRe.FindStringSubmatch(m)[1]
+			val, ok := fields[name]
+			if !ok || val == "" {
+				drop = true
+				return ""
+			}
+			return val
+		})
+		if drop {
+			continue
+		}
+		args = append(args, expanded)
+	}
+	return args
+}
+
+// profileExtraArgs 读取 [profiles.<name>] 小节，把里面的 key/value 转成额外的命令行参数追加在末尾，
+// value 为空时当作开关型参数处理（只传 --key，不带 =value）
+func profileExtraArgs(cfg *Config, profile string) []string {
+	if profile == "" {
+		return nil
+	}
+	extra, ok := cfg.Profiles[profile]
+	if !ok {
+		return nil
+	}
+	var args []string
+	for k, v := range extra {
+		if v == "" {
+			args = append(args, "--"+k)
+		} else {
+			args = append(args, "--"+k+"="+v)
+		}
+	}
+	return args
+}
+
+// ==========================================
+// 4. 播放列表 (Playlist)
+// ==========================================
+
+// playlistTempPath 在日志同目录下生成一个临时播放列表文件名，ext 带点，例如 ".m3u8"
+func playlistTempPath(cfg *Config, ext string) string {
+	dir := filepath.Dir(cfg.LogPath)
+	name := fmt.Sprintf("mpv-handler-playlist-%d%s", os.Getpid(), ext)
+	return filepath.Join(dir, name)
+}
+
+// mpvPlaylistArgs 把 Payload.Playlist 转成 mpv 的按文件分组参数：每个条目用 --{ ... --}
+// 包起来，字幕/起始时间/profile 作为该条目专属的选项放在 URL 前面。mpv 原生播放列表文件（m3u8/dpl）
+// 没有携带这些逐条目选项的手段，只能通过命令行的分组语法或者控制桥逐条 loadfile 来实现
+//
+// 注意这是有意跟最初的方案（写一个临时 .m3u8/EDL 文件、退出后删掉）分道扬镳：写文件那版
+// 靠自定义的 #EXT-MPV-* 注释指令携带这些元数据，而 mpv 原生解析器压根不认识、会直接忽略，
+// 字幕/起始时间/profile 从来没真正传进去过。命令行分组语法是 mpv 唯一会认的逐条目选项机制，
+// 所以这里没有临时文件可删，跟 PotPlayer 那边（.dpl 文件是真格式，直接支持 subtitle 字段）
+// 走文件路径不再对称，是权衡过的取舍，不是漏做
+func mpvPlaylistArgs(p *Payload) []string {
+	var args []string
+	for _, item := range p.Playlist {
+		args = append(args, "--{")
+		if item.Sub != "" {
+			args = append(args, "--sub-file="+item.Sub)
+		}
+		if item.Start != "" {
+			args = append(args, "--start="+item.Start)
+		}
+		profile := item.Profile
+		if profile == "" {
+			profile = p.Profile
+		}
+		if profile != "" {
+			args = append(args, "--profile="+profile)
+		}
+		args = append(args, item.Url)
+		args = append(args, "--}")
+	}
+	return args
+}
+
+// writePotplayerPlaylist 把 Payload.Playlist 写成 PotPlayer 的 .dpl 播放列表格式
+func writePotplayerPlaylist(cfg *Config, p *Payload) (string, error) {
+	path := playlistTempPath(cfg, ".dpl")
+	var b strings.Builder
+	b.WriteString("DAUMPLAYLIST\n")
+	for i, item := range p.Playlist {
+		n := i + 1
+		title := item.Title
+		if title == "" {
+			title = item.Url
+		}
+		b.WriteString(fmt.Sprintf("%d*file*%s\n", n, item.Url))
+		b.WriteString(fmt.Sprintf("%d*title*%s\n", n, title))
+		if item.Sub != "" {
+			b.WriteString(fmt.Sprintf("%d*subtitle*%s\n", n, item.Sub))
+		}
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return "", fmt.Errorf("write dpl playlist: %w", err)
+	}
+	return path, nil
 }
 
 // ==========================================
-// 3. 工具函数 (Utils)
+// 5. HLS 代理 (Proxy)
+// ==========================================
+
+// proxySession 是一次代理会话共用的状态：认证头、分片缓存目录、拉流用的 http.Client
+type proxySession struct {
+	headers       map[string]string
+	cacheDir      string
+	cacheMaxBytes int64
+	client        *http.Client
+
+	// variants 缓存递归改写过的嵌套子播放列表（master playlist 里 #EXT-X-STREAM-INF 指向的那些），
+	// key 是原始地址的 base64，serveVariant 优先从这里取，取不到再现抓现改写
+	variantsMu sync.Mutex
+	variants   map[string][]byte
+}
+
+// needsHLSProxy 判断这次播放要不要走本地 HLS 代理：
+// proxy=hls 是用户强制指定，proxy=auto 则按有没有带 Headers、URL 像不像 m3u8 来猜
+func needsHLSProxy(p *Payload) bool {
+	switch p.Proxy {
+	case "hls":
+		return true
+	case "auto":
+		return len(p.Headers) > 0 && strings.Contains(strings.ToLower(p.Url), ".m3u8")
+	default:
+		return false
+	}
+}
+
+// startHLSProxy 启动一个绑定在 127.0.0.1 随机端口上的本地 HTTP 服务：
+// 先把远端 m3u8 拉一遍并把每个分片/密钥 URI 改写成走本地代理的地址（这样播放器就不用知道 Authorization/X-Emby-Token 了），
+// 分片首次经过时落盘缓存，返回的 stop() 会在播放器退出后关服务、清缓存目录
+func startHLSProxy(cfg *Config, p *Payload) (string, func(), error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, fmt.Errorf("listen for hls proxy: %w", err)
+	}
+
+	cacheDir, err := os.MkdirTemp("", "mpv-handler-hlscache-*")
+	if err != nil {
+		listener.Close()
+		return "", nil, fmt.Errorf("create hls cache dir: %w", err)
+	}
+
+	maxMB := cfg.ProxyCacheMaxMB
+	if maxMB <= 0 {
+		maxMB = 512
+	}
+	sess := &proxySession{
+		headers:       p.Headers,
+		cacheDir:      cacheDir,
+		cacheMaxBytes: int64(maxMB) * 1024 * 1024,
+		client:        &http.Client{},
+		variants:      make(map[string][]byte),
+	}
+
+	playlist, err := sess.fetchAndRewritePlaylist(p.Url)
+	if err != nil {
+		os.RemoveAll(cacheDir)
+		listener.Close()
+		return "", nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Write(playlist)
+	})
+	mux.HandleFunc("/segment", sess.serveSegment)
+	mux.HandleFunc("/variant", sess.serveVariant)
+
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(listener)
+
+	stop := func() {
+		srv.Close()
+		os.RemoveAll(cacheDir)
+	}
+
+	localURL := fmt.Sprintf("http://%s/master.m3u8", listener.Addr().String())
+	return localURL, stop, nil
+}
+
+// keyURIRe 匹配 #EXT-X-KEY 行里的 URI="..." 属性，密钥地址也要走代理，不然解密不了
+var keyURIRe = regexp.MustCompile(`URI="([^"]+)"`)
+
+// fetchAndRewritePlaylist 下载一次 m3u8，把里面所有指向远端的分片/密钥地址换成本地代理地址。
+// 如果这是一份 master/adaptive playlist（#EXT-X-STREAM-INF 或 #EXT-X-I-FRAME-STREAM-INF 后面跟着的变体 m3u8），
+// 变体本身也是一份播放列表而不是分片，会递归地把它也下载改写一遍，不然变体里的分片/密钥地址还是原始鉴权地址，
+// mpv 直接请求变体、再从变体里读到的分片地址就绕过了代理，认证失败
+func (s *proxySession) fetchAndRewritePlaylist(rawURL string) ([]byte, error) {
+	body, err := s.fetch(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	base, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse playlist url: %w", err)
+	}
+
+	lines := strings.Split(string(body), "\n")
+	variant := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			continue
+		case strings.HasPrefix(trimmed, "#EXT-X-STREAM-INF") || strings.HasPrefix(trimmed, "#EXT-X-I-FRAME-STREAM-INF"):
+			variant = true
+		case strings.HasPrefix(trimmed, "#EXT-X-KEY"):
+			lines[i] = keyURIRe.ReplaceAllStringFunc(line, func(m string) string {
+				sub := keyURIRe.FindStringSubmatch(m)[1]
+				return `URI="` + s.proxiedURL(base, sub) + `"`
+			})
+		case strings.HasPrefix(trimmed, "#"):
+			continue
+		case variant:
+			variant = false
+			lines[i] = s.proxiedVariantURL(base, trimmed)
+		default:
+			lines[i] = s.proxiedURL(base, trimmed)
+		}
+	}
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// proxiedURL 把一个（可能是相对路径的）分片/密钥地址解析成绝对地址，编码进本地 /segment 链接里
+func (s *proxySession) proxiedURL(base *url.URL, ref string) string {
+	resolved, err := base.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	token := base64.StdEncoding.EncodeToString([]byte(resolved.String()))
+	return "/segment?src=" + url.QueryEscape(token)
+}
+
+// proxiedVariantURL 把 master playlist 里指向的变体 m3u8 解析成绝对地址，立刻递归抓取改写一遍并缓存结果，
+// 返回本地 /variant 代理地址；抓取失败也不影响主流程，交给 serveVariant 在真正被请求时再重试一次
+func (s *proxySession) proxiedVariantURL(base *url.URL, ref string) string {
+	resolved, err := base.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	resolvedURL := resolved.String()
+	token := base64.StdEncoding.EncodeToString([]byte(resolvedURL))
+
+	if rewritten, err := s.fetchAndRewritePlaylist(resolvedURL); err == nil {
+		s.variantsMu.Lock()
+		s.variants[token] = rewritten
+		s.variantsMu.Unlock()
+	}
+	return "/variant?src=" + url.QueryEscape(token)
+}
+
+// serveSegment 处理 /segment 请求：缓存命中直接返回，否则带上原始认证头去远端拉一份、落盘缓存后再返回
+func (s *proxySession) serveSegment(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("src")
+	raw, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		http.Error(w, "bad segment token", http.StatusBadRequest)
+		return
+	}
+	src := string(raw)
+	cachePath := filepath.Join(s.cacheDir, segmentCacheKey(src))
+
+	if data, err := os.ReadFile(cachePath); err == nil {
+		w.Write(data)
+		return
+	}
+
+	data, err := s.fetch(src)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	os.WriteFile(cachePath, data, 0644)
+	enforceCacheLimit(s.cacheDir, s.cacheMaxBytes)
+	w.Write(data)
+}
+
+// serveVariant 处理 /variant 请求：返回递归改写过的嵌套子播放列表。
+// 正常情况下 proxiedVariantURL 已经预先抓取改写好放进了 variants 缓存，这里直接命中；
+// 缓存里没有（比如缓存时抓取失败，或者播放器绕过 master.m3u8 直接请求了这个地址）就现抓现改写一份
+func (s *proxySession) serveVariant(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("src")
+
+	s.variantsMu.Lock()
+	data, ok := s.variants[token]
+	s.variantsMu.Unlock()
+
+	if !ok {
+		raw, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			http.Error(w, "bad variant token", http.StatusBadRequest)
+			return
+		}
+		rewritten, err := s.fetchAndRewritePlaylist(string(raw))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		data = rewritten
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Write(data)
+}
+
+// segmentCacheKey 把分片的原始地址哈希成一个能当文件名用的 key
+func segmentCacheKey(src string) string {
+	h := fnv.New32a()
+	h.Write([]byte(src))
+	return fmt.Sprintf("%x", h.Sum32())
+}
+
+// fetch 带上代理会话的认证头去请求一个地址，返回响应体
+func (s *proxySession) fetch(rawURL string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("upstream status %d for %s", resp.StatusCode, rawURL)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// enforceCacheLimit 缓存目录超过上限时，从最老的文件开始删，直到低于上限
+func enforceCacheLimit(dir string, maxBytes int64) {
+	if maxBytes <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	type cachedFile struct {
+		path string
+		size int64
+		mod  time.Time
+	}
+	var files []cachedFile
+	var total int64
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, cachedFile{filepath.Join(dir, e.Name()), info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+	if total <= maxBytes {
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].mod.Before(files[j].mod) })
+	for _, f := range files {
+		if total <= maxBytes {
+			break
+		}
+		if os.Remove(f.path) == nil {
+			total -= f.size
+		}
+	}
+}
+
+// ==========================================
+// 6. 预检探测与字幕/音轨自动发现 (Probe & Sidecar Discovery)
+// ==========================================
+
+// sidecarSubExts / sidecarAudioExts 是自动发现时认的同名兄弟文件后缀
+var sidecarSubExts = map[string]bool{".srt": true, ".ass": true, ".vtt": true}
+var sidecarAudioExts = map[string]bool{".aac": true, ".flac": true, ".m4a": true, ".mka": true}
+
+// runPreLaunchProbe 在拉起播放器之前用 ffprobe 探测一下流：
+// 能连上就把编码、分辨率、时长记进日志；连不上（信令过期、鉴权失败、404）就直接返回错误，不再浪费时间拉起播放器。
+// 顺带一提，如果 Url 是本地 file:// 路径，还会扫一遍同目录的字幕/音轨兄弟文件自动挂上
+func runPreLaunchProbe(cfg *Config, p *Payload) error {
+	if !cfg.ProbeEnabled {
+		return nil
+	}
+	if cfg.ProbePath == "" {
+		return fmt.Errorf("probe enabled but [probe] ffprobe path is empty")
+	}
+
+	args := []string{"-v", "error",
+		"-show_entries", "format=duration:stream=codec_name,width,height",
+		"-of", "json"}
+	if len(p.Headers) > 0 {
+		// 探测认证过的流（例如 Jellyfin 的 X-Emby-Token）时也要带上鉴权头，
+		// 不然 ffprobe 会先被 401/403 挡下来，探测直接失败
+		args = append(args, "-headers", ffprobeHeaders(p.Headers))
+	}
+	args = append(args, p.Url)
+
+	out, err := exec.Command(cfg.ProbePath, args...).Output()
+	if err != nil {
+		return fmt.Errorf("ffprobe could not read stream (expired link or bad auth?): %w", err)
+	}
+
+	var info struct {
+		Streams []struct {
+			CodecName string `json:"codec_name"`
+			Width     int    `json:"width"`
+			Height    int    `json:"height"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &info); err == nil && len(info.Streams) > 0 {
+		s := info.Streams[0]
+		writeLog(cfg, fmt.Sprintf("Probe OK: codec=%s resolution=%dx%d duration=%s", s.CodecName, s.Width, s.Height, info.Format.Duration))
+	}
+
+	discoverSidecars(p)
+	return nil
+}
+
+// ffprobeHeaders 把 Headers 拼成 ffprobe -headers 参数要求的 "K: V\r\n" 格式
+func ffprobeHeaders(headers map[string]string) string {
+	var b strings.Builder
+	for k, v := range headers {
+		b.WriteString(k)
+		b.WriteString(": ")
+		b.WriteString(v)
+		b.WriteString("\r\n")
+	}
+	return b.String()
+}
+
+// discoverSidecars 只对本地 file:// 路径生效：扫描同目录里文件名前缀相同的字幕/音轨文件
+// （例如 Movie.srt、Movie.en.srt、Movie.flac 都会被 Movie.mkv 认领），没有字幕时优先填 Sub，
+// 后面的追加进 extraSubs 供 --sub-files 使用
+func discoverSidecars(p *Payload) {
+	const fileURLPrefix = "file://"
+	if !strings.HasPrefix(p.Url, fileURLPrefix) {
+		return
+	}
+	localPath := strings.TrimPrefix(p.Url, fileURLPrefix)
+	dir := filepath.Dir(localPath)
+	base := strings.TrimSuffix(filepath.Base(localPath), filepath.Ext(localPath))
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		// 必须是 base 后面紧跟一个点才算同名兄弟文件，不然 "Episode1.mkv" 会连 "Episode10.srt"、
+		// "Episode11.en.srt" 这种前缀相同但其实是别的集数的字幕一起认领
+		if !strings.HasPrefix(name, base+".") {
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(name))
+		full := filepath.Join(dir, name)
+
+		switch {
+		case sidecarSubExts[ext]:
+			if p.Sub == "" {
+				p.Sub = full
+			} else {
+				p.extraSubs = append(p.extraSubs, full)
+			}
+		case sidecarAudioExts[ext] && p.audioFile == "":
+			p.audioFile = full
+		}
+	}
+}
+
+// ==========================================
+// 7. IPC 控制桥 (Control Bridge)
+// ==========================================
+
+// Instance 记录一个正在运行的播放器实例，控制桥按 ID 查找它对应的 IPC 管道
+type Instance struct {
+	ID       string
+	PipeName string
+	Cmd      *exec.Cmd
+}
+
+var (
+	instancesMu sync.Mutex
+	instances   = make(map[string]*Instance)
+	bridgeSrv   *http.Server
+)
+
+// instanceID 为一次播放生成稳定的实例 ID：优先用 Payload.Instance，否则退化为 Url 的哈希
+func instanceID(p *Payload) string {
+	if p.Instance != "" {
+		return p.Instance
+	}
+	h := fnv.New32a()
+	h.Write([]byte(p.Url))
+	return fmt.Sprintf("%x", h.Sum32())
+}
+
+// mpvIPCPipeName 返回某个实例对应的 mpv --input-ipc-server 命名管道
+func mpvIPCPipeName(id string) string {
+	return `\\.\pipe\mpv-handler-` + id
+}
+
+// BridgeRequest 是控制桥 HTTP 接口接受的请求体，例如：
+//
+//	{"id":"...","cmd":["seek",30]}
+//	{"id":"...","cmd":"pause"}
+type BridgeRequest struct {
+	ID  string      `json:"id"`
+	Cmd interface{} `json:"cmd"`
+}
+
+// registerInstance 把刚启动的播放器实例登记进注册表，按需拉起控制桥。
+// exited 应该是一个在播放器进程退出后被关闭的 channel（调用方负责 cmd.Wait()），
+// 这里只是借它来触发注册表清理，避免多处都去 Wait 同一个 *exec.Cmd
+func registerInstance(cfg *Config, id, pipeName string, cmd *exec.Cmd, exited <-chan struct{}) {
+	inst := &Instance{ID: id, PipeName: pipeName, Cmd: cmd}
+
+	instancesMu.Lock()
+	instances[id] = inst
+	instancesMu.Unlock()
+
+	ensureBridgeStarted(cfg)
+
+	go func() {
+		<-exited
+
+		// 只有 instances[id] 还指向这个实例本身才能删：replace 策略会杀掉旧进程后立刻把新实例
+		// 注册到同一个 id 上，旧实例的退出回调这时候才姗姗来迟，不加这个判断会把刚注册的新实例
+		// 顶掉，误判成"没实例了"进而把控制桥也关掉
+		instancesMu.Lock()
+		if instances[id] == inst {
+			delete(instances, id)
+		}
+		empty := len(instances) == 0
+		instancesMu.Unlock()
+
+		if empty {
+			stopBridge()
+		}
+	}()
+}
+
+// ensureBridgeStarted 按需启动控制桥的本地 HTTP 服务，已经在跑的话什么都不做
+func ensureBridgeStarted(cfg *Config) {
+	instancesMu.Lock()
+	already := bridgeSrv != nil
+	if already {
+		instancesMu.Unlock()
+		return
+	}
+	port := cfg.BridgePort
+	if port == 0 {
+		port = 9876
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleBridgeRequest)
+	srv := &http.Server{Addr: fmt.Sprintf("127.0.0.1:%d", port), Handler: mux}
+	bridgeSrv = srv
+	instancesMu.Unlock()
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			writeLog(cfg, "Bridge Error: "+err.Error())
+
+			// 绑定失败也要把 bridgeSrv 清空，不然下一次 ensureBridgeStarted 会看到一个
+			// 已经死掉的 *http.Server 就直接跳过，之后再也没有机会重试
+			instancesMu.Lock()
+			if bridgeSrv == srv {
+				bridgeSrv = nil
+			}
+			instancesMu.Unlock()
+		}
+	}()
+}
+
+// stopBridge 在没有存活实例时关掉控制桥，避免端口一直占着
+func stopBridge() {
+	instancesMu.Lock()
+	srv := bridgeSrv
+	bridgeSrv = nil
+	instancesMu.Unlock()
+	if srv != nil {
+		srv.Close()
+	}
+}
+
+// handleBridgeRequest 把 HTTP 请求里的命令转发给对应实例的 mpv JSON IPC 管道，并把回复原样返回
+func handleBridgeRequest(w http.ResponseWriter, r *http.Request) {
+	var req BridgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	instancesMu.Lock()
+	inst, ok := instances[req.ID]
+	instancesMu.Unlock()
+	if !ok {
+		http.Error(w, "unknown instance id: "+req.ID, http.StatusNotFound)
+		return
+	}
+
+	reply, err := sendMpvIPC(inst.PipeName, req.Cmd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(reply)
+}
+
+// sendMpvIPC 把命令编码成 mpv JSON IPC 的格式写进命名管道，然后读回第一行回复
+func sendMpvIPC(pipeName string, cmd interface{}) ([]byte, error) {
+	conn, err := os.OpenFile(pipeName, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open pipe %s: %w", pipeName, err)
+	}
+	defer conn.Close()
+
+	msg, err := json.Marshal(map[string]interface{}{"command": normalizeIPCCmd(cmd)})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(msg, '\n')); err != nil {
+		return nil, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// normalizeIPCCmd 兼容两种写法：`"cmd":"pause"` 这种单个命令名，和 `"cmd":["seek",30]` 这种完整命令数组
+func normalizeIPCCmd(cmd interface{}) []interface{} {
+	if arr, ok := cmd.([]interface{}); ok {
+		return arr
+	}
+	return []interface{}{cmd}
+}
+
+// ==========================================
+// 8. 工具函数 (Utils)
 // ==========================================
 
 func iniPathForExe(exe string) string {
@@ -96,18 +973,72 @@ func iniPathForExe(exe string) string {
 func loadConfig() *Config {
 	exe, _ := os.Executable()
 	defaultLog := filepath.Join(filepath.Dir(exe), "mpv-handler.log")
-	cfg := &Config{EnableLog: true, LogPath: defaultLog}
+	cfg := &Config{
+		EnableLog: true,
+		LogPath:   defaultLog,
+		Players:   make(map[string]PlayerEntry),
+		Profiles:  make(map[string]map[string]string),
+	}
 
 	iniPath := iniPathForExe(exe)
 	f, err := ini.Load(iniPath)
-	if err == nil {
-		sec := f.Section("players")
-		cfg.MpvPath = sec.Key("mpv").String()
-		cfg.PotPath = sec.Key("potplayer").String()
-		
-		secLog := f.Section("config")
-		cfg.EnableLog = secLog.Key("log").MustBool(true)
+	if err != nil {
+		return cfg
+	}
+
+	// [players] 小节：`<name> = <path>` 给出可执行文件路径，`<name>_template = <template>` 给出命令行模板
+	sec := f.Section("players")
+	entries := make(map[string]PlayerEntry)
+	for _, key := range sec.Keys() {
+		name := key.Name()
+		if strings.HasSuffix(name, "_template") {
+			player := strings.TrimSuffix(name, "_template")
+			entry := entries[player]
+			entry.Template = key.String()
+			entries[player] = entry
+			continue
+		}
+		entry := entries[name]
+		entry.BinPath = key.String()
+		entries[name] = entry
+	}
+	cfg.Players = entries
+
+	// [profiles.<name>] 小节：播放时按 Payload.Profile 匹配，追加额外参数
+	for _, s := range f.Sections() {
+		if !strings.HasPrefix(s.Name(), "profiles.") {
+			continue
+		}
+		profile := strings.TrimPrefix(s.Name(), "profiles.")
+		extra := make(map[string]string)
+		for _, key := range s.Keys() {
+			extra[key.Name()] = key.String()
+		}
+		cfg.Profiles[profile] = extra
 	}
+
+	secLog := f.Section("config")
+	cfg.EnableLog = secLog.Key("log").MustBool(true)
+
+	// [bridge] 小节：控制 mpv IPC 控制桥要不要开、监听哪个本地端口
+	secBridge := f.Section("bridge")
+	cfg.BridgeEnabled = secBridge.Key("enabled").MustBool(false)
+	cfg.BridgePort = secBridge.Key("port").MustInt(9876)
+
+	// [probe] 小节：要不要在播放前用 ffprobe 探测流、ffprobe.exe 在哪
+	secProbe := f.Section("probe")
+	cfg.ProbeEnabled = secProbe.Key("enabled").MustBool(false)
+	cfg.ProbePath = secProbe.Key("ffprobe").String()
+
+	// [proxy] 小节：HLS 代理的本地分片缓存上限
+	secProxy := f.Section("proxy")
+	cfg.ProxyCacheMaxMB = secProxy.Key("cache_max_mb").MustInt(512)
+
+	// [single_instance] 小节：重复点击协议链接时的处理策略
+	secSingle := f.Section("single_instance")
+	cfg.SingleInstanceEnabled = secSingle.Key("enabled").MustBool(false)
+	cfg.SingleInstanceOnDuplicate = secSingle.Key("on_duplicate").MustString("new-window")
+
 	return cfg
 }
 
@@ -138,18 +1069,18 @@ func parsePayload(rawURI string) (*Payload, error) {
 	// 1. 只有 '-'，没有 '+'
 	// 2. 只有 '_', 没有 '/' (关键点！)
 	// 因此，如果我们读到了 '/'，那绝对是 Windows/浏览器在 URL 末尾画蛇添足加的斜杠，必须扔掉。
-	
+
 	var cleanBuilder strings.Builder
 	for _, r := range rawStr {
 		switch {
 		// 1. 保留标准字母数字
 		case (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9'):
 			cleanBuilder.WriteRune(r)
-		
+
 		// 2. 归一化 '+' 和 '-' 为 '+'
 		case r == '-' || r == '+':
 			cleanBuilder.WriteRune('+')
-		
+
 		// 3. 归一化 '_' 为 '/' (这是 JS 发来的有效数据)
 		case r == '_':
 			cleanBuilder.WriteRune('/')
@@ -159,8 +1090,8 @@ func parsePayload(rawURI string) (*Payload, error) {
 		// 所以这里的 slash 只能是系统加的尾部路径符，或者是用户复制粘贴时的误触。
 		case r == '/':
 			continue
-		
-		// 5. 其他字符(空格、引号等)全部丢弃
+
+			// 5. 其他字符(空格、引号等)全部丢弃
 		}
 	}
 	cleanStr := cleanBuilder.String()
@@ -182,6 +1113,16 @@ func parsePayload(rawURI string) (*Payload, error) {
 	jsonStr = strings.Trim(jsonStr, "\x00\x0f")
 
 	var p Payload
+	// 播放列表还支持省略外层 {"mode":...} 的简写形式，直接传一个条目数组，
+	// 这种情况下默认丢给 mpv 播放
+	if strings.HasPrefix(jsonStr, "[") {
+		if err := json.Unmarshal([]byte(jsonStr), &p.Playlist); err != nil {
+			return nil, fmt.Errorf("json error: %w", err)
+		}
+		p.Target = "mpv"
+		return &p, nil
+	}
+
 	if err := json.Unmarshal([]byte(jsonStr), &p); err != nil {
 		return nil, fmt.Errorf("json error: %w", err)
 	}
@@ -189,7 +1130,135 @@ func parsePayload(rawURI string) (*Payload, error) {
 }
 
 // ==========================================
-// 4. 注册表操作 (Installer)
+// 9. 单实例协调 (Single Instance)
+// ==========================================
+
+const (
+	// singleInstanceMutexName 是全局命名互斥体，谁创建成功谁就是"服务端"（第一个实例）
+	singleInstanceMutexName = `Global\jelly-player-handler-singleton`
+	// singleInstancePipeName 是服务端监听的命名管道，后来者把 Payload 转发到这里
+	singleInstancePipeName = `\\.\pipe\jelly-player-handler`
+)
+
+// acquireSingleInstanceLock 尝试创建全局命名互斥体。
+// 返回 true 表示当前进程是第一个实例（应当留下来当服务端），false 表示已有实例在跑
+func acquireSingleInstanceLock() (bool, error) {
+	namePtr, err := windows.UTF16PtrFromString(singleInstanceMutexName)
+	if err != nil {
+		return false, err
+	}
+	handle, err := windows.CreateMutex(nil, false, namePtr)
+	if handle == 0 {
+		return false, err
+	}
+	if err == windows.ERROR_ALREADY_EXISTS {
+		// 互斥体已经被别的实例创建了，说明自己不是第一个，拿不到服务端身份
+		windows.CloseHandle(handle)
+		return false, nil
+	}
+	return true, nil
+}
+
+// forwardToRunningInstance 把当前收到的 Payload 序列化后写给已经在跑的服务端实例
+func forwardToRunningInstance(p *Payload) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(singleInstancePipeName, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("dial single-instance pipe: %w", err)
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// runSingleInstanceServer 常驻监听 singleInstancePipeName，把后续收到的 Payload
+// 逐个交给 handleDuplicatePayload 处理，直到进程被关闭为止
+func runSingleInstanceServer(cfg *Config) {
+	namePtr, err := windows.UTF16PtrFromString(singleInstancePipeName)
+	if err != nil {
+		writeLog(cfg, "Single-instance server init error: "+err.Error())
+		return
+	}
+
+	for {
+		handle, err := windows.CreateNamedPipe(
+			namePtr,
+			windows.PIPE_ACCESS_DUPLEX,
+			windows.PIPE_TYPE_MESSAGE|windows.PIPE_READMODE_MESSAGE|windows.PIPE_WAIT,
+			windows.PIPE_UNLIMITED_INSTANCES,
+			4096, 4096, 0, nil,
+		)
+		if err != nil {
+			writeLog(cfg, "Single-instance pipe create error: "+err.Error())
+			return
+		}
+
+		err = windows.ConnectNamedPipe(handle, nil)
+		if err != nil && err != windows.ERROR_PIPE_CONNECTED {
+			windows.CloseHandle(handle)
+			continue
+		}
+
+		conn := os.NewFile(uintptr(handle), singleInstancePipeName)
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			var p Payload
+			if err := json.Unmarshal(scanner.Bytes(), &p); err != nil {
+				writeLog(cfg, "Single-instance decode error: "+err.Error())
+				continue
+			}
+			handleDuplicatePayload(cfg, &p)
+		}
+		conn.Close()
+	}
+}
+
+// handleDuplicatePayload 按 [single_instance] 的 on_duplicate 策略处理重复点击的 Payload：
+//   - replace: 关掉当前正在跑的 mpv 实例，重新拉起新的
+//   - append: 通过控制桥把新地址追加进当前 mpv 实例的播放列表
+//   - ignore: 什么都不做
+//   - new-window (默认): 正常再开一个播放器窗口
+func handleDuplicatePayload(cfg *Config, p *Payload) {
+	policy := cfg.SingleInstanceOnDuplicate
+
+	if policy == "ignore" {
+		writeLog(cfg, "Single-instance: ignoring duplicate payload per policy")
+		return
+	}
+
+	if (policy == "replace" || policy == "append") && p.Target == "mpv" && cfg.BridgeEnabled {
+		instancesMu.Lock()
+		var current *Instance
+		for _, inst := range instances {
+			current = inst
+			break
+		}
+		instancesMu.Unlock()
+
+		if current != nil {
+			if policy == "append" {
+				if _, err := sendMpvIPC(current.PipeName, []interface{}{"loadfile", p.Url, "append-play"}); err == nil {
+					writeLog(cfg, "Single-instance: appended duplicate payload to running mpv")
+					return
+				}
+				writeLog(cfg, "Single-instance: append-play failed, falling back to new window")
+			} else {
+				current.Cmd.Process.Kill()
+				writeLog(cfg, "Single-instance: replaced running mpv instance")
+			}
+		}
+	}
+
+	dispatchPayload(cfg, p)
+}
+
+// ==========================================
+// 10. 注册表操作 (Installer)
 // ==========================================
 
 func install(exePath string) {
@@ -222,9 +1291,79 @@ func install(exePath string) {
 }
 
 // ==========================================
-// 5. 主程序入口 (Main)
+// 11. 主程序入口 (Main)
 // ==========================================
 
+// dispatchPayload 跑完探测、找播放器路径、构建命令行、启动进程这一整套流程。
+// 返回的 channel 会在播放器进程退出后关闭；流程中途就失败，或者启动成功但既没有收尾回调、也没开控制桥时返回 nil，调用方不用等。
+// 这段逻辑被抽成独立函数是因为单实例服务端既要处理自己启动时的 Payload，也要处理后续转发过来的重复 Payload
+func dispatchPayload(cfg *Config, p *Payload) <-chan struct{} {
+	if err := runPreLaunchProbe(cfg, p); err != nil {
+		writeLog(cfg, "Probe Error: "+err.Error())
+		return nil
+	}
+
+	entry, known := cfg.Players[p.Target]
+	if !known {
+		writeLog(cfg, "Unknown Target Mode: "+p.Target)
+		return nil
+	}
+	binPath := entry.BinPath
+	if binPath == "" {
+		writeLog(cfg, fmt.Sprintf("Path not configured for mode: %s", p.Target))
+		return nil
+	}
+
+	// 未知的播放器名字（用户自定义的 vlc/iina 等）一律走模板驱动的通用处理器，
+	// 只要 INI 里配了 *_template 就不用碰代码
+	handler, ok := Handlers[p.Target]
+	if !ok {
+		if entry.Template == "" {
+			writeLog(cfg, "No template configured for: "+p.Target)
+			return nil
+		}
+		handler = buildGenericCmd
+	}
+
+	cmd, cleanup := handler(cfg, binPath, p)
+	writeLog(cfg, fmt.Sprintf("Executing: %s %v", cmd.Path, cmd.Args))
+
+	if err := cmd.Start(); err != nil {
+		writeLog(cfg, "Launch Error: "+err.Error())
+		if cleanup != nil {
+			cleanup()
+		}
+		return nil
+	}
+
+	// 没有收尾回调、也没有开控制桥的话，进程可以直接退出，不用等播放器
+	if cleanup == nil && !(p.Target == "mpv" && cfg.BridgeEnabled) {
+		return nil
+	}
+
+	// 控制桥 / 收尾回调都要等播放器真正退出才能收尾，这里只 Wait 一次，
+	// 通过 exited channel 广播给两边，避免同一个 *exec.Cmd 被 Wait 两次
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	if p.Target == "mpv" && cfg.BridgeEnabled {
+		id := instanceID(p)
+		registerInstance(cfg, id, mpvIPCPipeName(id), cmd, exited)
+	}
+
+	if cleanup != nil {
+		go func() {
+			<-exited
+			cleanup()
+		}()
+	}
+
+	return exited
+}
+
 func main() {
 	exe, _ := os.Executable()
 	cfg := loadConfig()
@@ -256,34 +1395,30 @@ func main() {
 	jsonBytes, _ := json.Marshal(p)
 	writeLog(cfg, fmt.Sprintf("Received Payload: %s", string(jsonBytes)))
 
-	// 3. 寻找播放器路径
-	var binPath string
-	switch p.Target {
-	case "mpv":
-		binPath = cfg.MpvPath
-	case "potplayer":
-		binPath = cfg.PotPath
-	default:
-		writeLog(cfg, "Unknown Target Mode: "+p.Target)
-		return
-	}
-
-	if binPath == "" {
-		writeLog(cfg, fmt.Sprintf("Path not configured for mode: %s", p.Target))
-		return
-	}
-
-	// 4. 调度执行 (Factory Dispatch)
-	handler, ok := Handlers[p.Target]
-	if !ok {
-		writeLog(cfg, "No handler implementation for: "+p.Target)
-		return
+	// 3. 单实例协调：第一个启动的实例留在后台当"服务端"，后续重复点击把 Payload 转发给它，
+	// 由服务端按 on_duplicate 策略决定开新窗口/替换/追加播放列表/忽略，解决 Video Wall 多开抢焦点的问题
+	if cfg.SingleInstanceEnabled {
+		isFirst, lockErr := acquireSingleInstanceLock()
+		if lockErr != nil {
+			writeLog(cfg, "Single-instance lock error, falling back to normal launch: "+lockErr.Error())
+		} else if !isFirst {
+			if err := forwardToRunningInstance(p); err == nil {
+				writeLog(cfg, "Forwarded duplicate payload to running instance")
+				return
+			} else {
+				writeLog(cfg, "Forward to running instance failed, falling back to local launch: "+err.Error())
+			}
+		} else {
+			dispatchPayload(cfg, p)
+			runSingleInstanceServer(cfg) // 阻塞到进程被关掉为止，持续接收后续的重复启动
+			return
+		}
 	}
 
-	cmd := handler(binPath, p)
-	writeLog(cfg, fmt.Sprintf("Executing: %s %v", cmd.Path, cmd.Args))
-
-	if err := cmd.Start(); err != nil {
-		writeLog(cfg, "Launch Error: "+err.Error())
+	// 4. 正常单次启动：等播放器退出（如果需要的话）再收尾退出
+	exited := dispatchPayload(cfg, p)
+	if exited != nil {
+		<-exited
 	}
+	os.Exit(0)
 }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTokenizeTemplate(t *testing.T) {
+	cases := []struct {
+		name     string
+		template string
+		want     []string
+	}{
+		{"simple fields", "%url% --profile=%profile%", []string{"%url%", "--profile=%profile%"}},
+		{"double quoted segment", `--title="%title% (extra)"`, []string{"--title=%title% (extra)"}},
+		{"single quoted segment", `--title='%title% (extra)'`, []string{"--title=%title% (extra)"}},
+		{"collapses repeated whitespace", "%url%   --profile=%profile%\t--geometry=%geometry%", []string{"%url%", "--profile=%profile%", "--geometry=%geometry%"}},
+		{"empty template", "", nil},
+		{"quote in the middle of a token", `--sub-file="%sub%"extra`, []string{"--sub-file=%sub%extra"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := tokenizeTemplate(tc.template)
+			if !equalStringSlices(got, tc.want) {
+				t.Errorf("tokenizeTemplate(%q) = %#v, want %#v", tc.template, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	fields := map[string]string{
+		"url":     "http://example.com/video.mkv",
+		"profile": "",
+		"sub":     "C:\\subs\\movie.srt",
+	}
+
+	cases := []struct {
+		name     string
+		template string
+		want     []string
+	}{
+		{"plain field", "%url%", []string{"http://example.com/video.mkv"}},
+		{"drops token with empty field", "%url% --profile=%profile%", []string{"http://example.com/video.mkv"}},
+		{"drops token when field missing entirely", "--geometry=%geometry%", nil},
+		{"keeps token when its field is present", "--sub-file=%sub%", []string{"--sub-file=C:\\subs\\movie.srt"}},
+		{"quoted segment with field", `--title="%url% (extra)"`, []string{"--title=http://example.com/video.mkv (extra)"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := expandTemplate(tc.template, fields)
+			if !equalStringSlices(got, tc.want) {
+				t.Errorf("expandTemplate(%q) = %#v, want %#v", tc.template, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestDiscoverSidecarsPrefixBoundary 覆盖同名兄弟文件匹配的边界：Episode1.mkv 不该认领
+// Episode10.srt / Episode11.en.srt / Episode1x.srt 这些前缀相同但其实是别的文件的字幕
+func TestDiscoverSidecarsPrefixBoundary(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{
+		"Episode1.mkv",
+		"Episode1.srt",
+		"Episode1.en.srt",
+		"Episode1.flac",
+		"Episode10.srt",
+		"Episode11.en.srt",
+		"Episode1x.srt",
+	}
+	for _, n := range names {
+		if err := os.WriteFile(filepath.Join(dir, n), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := &Payload{Url: "file://" + filepath.ToSlash(filepath.Join(dir, "Episode1.mkv"))}
+	discoverSidecars(p)
+
+	if !strings.HasSuffix(p.Sub, "Episode1.en.srt") {
+		t.Errorf("Sub = %q, want it to end with Episode1.en.srt", p.Sub)
+	}
+	if len(p.extraSubs) != 1 || !strings.HasSuffix(p.extraSubs[0], "Episode1.srt") {
+		t.Errorf("extraSubs = %v, want exactly [.../Episode1.srt]", p.extraSubs)
+	}
+	if !strings.HasSuffix(p.audioFile, "Episode1.flac") {
+		t.Errorf("audioFile = %q, want it to end with Episode1.flac", p.audioFile)
+	}
+
+	for _, wrong := range []string{"Episode10.srt", "Episode11.en.srt", "Episode1x.srt"} {
+		if strings.HasSuffix(p.Sub, wrong) || strings.HasSuffix(p.audioFile, wrong) {
+			t.Errorf("sidecar discovery wrongly picked up %s", wrong)
+		}
+		for _, extra := range p.extraSubs {
+			if strings.HasSuffix(extra, wrong) {
+				t.Errorf("extraSubs wrongly picked up %s", wrong)
+			}
+		}
+	}
+}
+
+// TestFetchAndRewritePlaylistRecursesIntoVariants 覆盖 master/adaptive playlist 的场景：
+// #EXT-X-STREAM-INF 后面跟着的变体 m3u8 要被递归抓取改写，而不是像分片一样直接透传，
+// 不然变体里的分片/密钥地址还是原始鉴权地址，播放器直接请求会失败
+func TestFetchAndRewritePlaylistRecursesIntoVariants(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000000\nvariant.m3u8\n"))
+	})
+	mux.HandleFunc("/variant.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\"\nsegment1.ts\nsegment2.ts\n"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	sess := &proxySession{client: server.Client(), variants: make(map[string][]byte)}
+
+	rewritten, err := sess.fetchAndRewritePlaylist(server.URL + "/master.m3u8")
+	if err != nil {
+		t.Fatalf("fetchAndRewritePlaylist: %v", err)
+	}
+	if strings.Contains(string(rewritten), "variant.m3u8") {
+		t.Errorf("master playlist should not reference the variant url directly: %s", rewritten)
+	}
+	if !strings.Contains(string(rewritten), "/variant?src=") {
+		t.Fatalf("master playlist should point the variant at /variant: %s", rewritten)
+	}
+
+	if len(sess.variants) != 1 {
+		t.Fatalf("expected the variant to be pre-fetched and cached, got %d entries", len(sess.variants))
+	}
+	var variantBody []byte
+	for _, v := range sess.variants {
+		variantBody = v
+	}
+	if strings.Contains(string(variantBody), "segment1.ts") || strings.Contains(string(variantBody), "key.bin") {
+		t.Errorf("nested playlist segments/keys should be rewritten to local proxy urls: %s", variantBody)
+	}
+	if !strings.Contains(string(variantBody), "/segment?src=") {
+		t.Errorf("nested playlist segments should be proxied: %s", variantBody)
+	}
+}
+
+// TestProxiedVariantURLCachesUnderResolvedURL 确认变体地址在写进 variants 缓存前先解析成了绝对地址，
+// 这样 serveVariant 才能用同一个 token 命中缓存
+func TestProxiedVariantURLCachesUnderResolvedURL(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hls/variant.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("#EXTM3U\nsegment.ts\n"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	base, err := url.Parse(server.URL + "/hls/master.m3u8")
+	if err != nil {
+		t.Fatalf("parse base url: %v", err)
+	}
+	sess := &proxySession{client: server.Client(), variants: make(map[string][]byte)}
+
+	proxied := sess.proxiedVariantURL(base, "variant.m3u8")
+	if !strings.HasPrefix(proxied, "/variant?src=") {
+		t.Fatalf("proxiedVariantURL = %q, want a /variant?src= url", proxied)
+	}
+
+	wantToken := base64.StdEncoding.EncodeToString([]byte(server.URL + "/hls/variant.m3u8"))
+	if _, ok := sess.variants[wantToken]; !ok {
+		t.Fatalf("variants cache missing entry for resolved url, got keys %v", mapKeys(sess.variants))
+	}
+}
+
+func mapKeys(m map[string][]byte) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func equalStringSlices(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}